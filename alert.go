@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v2"
+)
+
+var alertSchema = `
+CREATE TABLE IF NOT EXISTS scout_alerts (
+	object_name TEXT NOT NULL,
+	rule        TEXT NOT NULL,
+	fired_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY(object_name, rule)
+);
+`
+
+// Alert describes a single rule crossing for a single object, as passed to
+// an alertSink.
+type Alert struct {
+	Rule       string
+	ObjectName string
+	Detail     Detail
+}
+
+// alertSink delivers a fired alert somewhere.
+type alertSink interface {
+	Send(Alert) error
+}
+
+// AlertConfig is the shape of the YAML file passed via --alert-config. It
+// names a set of sinks and a set of rules that decide which alerts, if any,
+// a detection should be routed to.
+type AlertConfig struct {
+	Sinks []SinkConfig `yaml:"sinks"`
+	Rules []RuleConfig `yaml:"rules"`
+}
+
+type SinkConfig struct {
+	Name     string              `yaml:"name"`
+	Type     string              `yaml:"type"` // webhook, smtp, mastodon or exec
+	Webhook  *WebhookSinkConfig  `yaml:"webhook,omitempty"`
+	SMTP     *SMTPSinkConfig     `yaml:"smtp,omitempty"`
+	Mastodon *MastodonSinkConfig `yaml:"mastodon,omitempty"`
+	Exec     *ExecSinkConfig     `yaml:"exec,omitempty"`
+}
+
+type WebhookSinkConfig struct {
+	URL string `yaml:"url"`
+}
+
+type SMTPSinkConfig struct {
+	Host string   `yaml:"host"`
+	Port int      `yaml:"port"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+}
+
+type MastodonSinkConfig struct {
+	InstanceURL string `yaml:"instance_url"`
+	AccessToken string `yaml:"access_token"`
+}
+
+type ExecSinkConfig struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+// RuleConfig names a single alerting rule. A rule fires when any one of its
+// thresholds is crossed; leave a threshold unset to ignore it.
+type RuleConfig struct {
+	Name               string   `yaml:"name"`
+	RatingAtLeast      *int     `yaml:"rating_at_least,omitempty"`
+	CaDistLessThan     *float64 `yaml:"ca_dist_less_than,omitempty"`
+	Neo1kmScoreAtLeast *int     `yaml:"neo1km_score_at_least,omitempty"`
+	NewObjectAnyRating bool     `yaml:"new_object_any_rating,omitempty"`
+	Sinks              []string `yaml:"sinks,omitempty"` // sink names to notify; all sinks if empty
+}
+
+func (r RuleConfig) matches(d Detail, isNew bool) bool {
+	if r.RatingAtLeast != nil {
+		if v, ok := d.Rating.V().(int); ok && v >= *r.RatingAtLeast {
+			return true
+		}
+	}
+	if r.CaDistLessThan != nil {
+		if v, ok := d.CaDist.V().(float64); ok && v < *r.CaDistLessThan {
+			return true
+		}
+	}
+	if r.Neo1kmScoreAtLeast != nil {
+		if v, ok := d.Neo1KmScore.V().(int); ok && v >= *r.Neo1kmScoreAtLeast {
+			return true
+		}
+	}
+	if r.NewObjectAnyRating && isNew {
+		if v, ok := d.Rating.V().(int); ok && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAlertConfig(path string) (*AlertConfig, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertConfig
+	if err := yaml.Unmarshal(body, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// runAlerts evaluates every rule in *alertConfigPath against the detections
+// in summaries, firing each matching rule at most once per (object_name,
+// rule) as recorded in scout_alerts. It is a no-op if *alertConfigPath is
+// unset.
+func runAlerts(summaries []Summary) error {
+	if *alertConfigPath == "" {
+		return nil
+	}
+
+	cfg, err := loadAlertConfig(*alertConfigPath)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	opts := buildConnectOptions()
+	db, err := sqlx.Connect("postgres", opts)
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(alertSchema); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+
+	sinks := make(map[string]alertSink, len(cfg.Sinks))
+	for _, s := range cfg.Sinks {
+		sink, err := newAlertSink(s)
+		if err != nil {
+			return fmt.Errorf("sink %s: %w", s.Name, err)
+		}
+		sinks[s.Name] = sink
+	}
+
+	for _, s := range summaries {
+		for _, d := range s.Data {
+			isNew, err := isNewObject(db, d.ObjectName, time.Time(d.LastRun))
+			if err != nil {
+				log.Printf("alerts: failed to check object history for %s: %v", d.ObjectName, err)
+				continue
+			}
+
+			for _, rule := range cfg.Rules {
+				if !rule.matches(d, isNew) {
+					continue
+				}
+
+				already, err := alertAlreadyFired(db, d.ObjectName, rule.Name)
+				if err != nil {
+					log.Printf("alerts: failed to check alert history for %s/%s: %v", d.ObjectName, rule.Name, err)
+					continue
+				}
+				if already {
+					continue // already alerted for this object/rule
+				}
+
+				alert := Alert{Rule: rule.Name, ObjectName: d.ObjectName, Detail: d}
+
+				targets := rule.Sinks
+				if len(targets) == 0 {
+					targets = allSinkNames(cfg.Sinks)
+				}
+
+				if *dryRunAlerts {
+					for _, name := range targets {
+						log.Printf("alerts: (dry run) would fire %s for %s via %s", rule.Name, d.ObjectName, name)
+					}
+					continue // dry runs must not mark the alert as fired
+				}
+
+				delivered := false
+				for _, name := range targets {
+					sink, ok := sinks[name]
+					if !ok {
+						log.Printf("alerts: rule %s references unknown sink %s", rule.Name, name)
+						continue
+					}
+
+					if err := sink.Send(alert); err != nil {
+						log.Printf("alerts: failed to send %s for %s via %s: %v", rule.Name, d.ObjectName, name, err)
+						continue
+					}
+					delivered = true
+				}
+
+				if !delivered {
+					continue // nothing delivered; leave it unrecorded so the next fetch retries
+				}
+
+				if err := recordAlert(db, d.ObjectName, rule.Name); err != nil {
+					log.Printf("alerts: failed to record alert %s for %s: %v", rule.Name, d.ObjectName, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func allSinkNames(sinks []SinkConfig) []string {
+	names := make([]string, len(sinks))
+	for i, s := range sinks {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// isNewObject reports whether this is the first time object_name has been
+// seen, i.e. no row exists with an earlier last_run.
+func isNewObject(db *sqlx.DB, objectName string, lastRun time.Time) (bool, error) {
+	var count int
+	if err := db.Get(&count, `SELECT count(*) FROM scout WHERE object_name = $1 AND last_run < $2`, objectName, lastRun); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+// alertAlreadyFired reports whether rule has already fired for objectName.
+func alertAlreadyFired(db *sqlx.DB, objectName, rule string) (bool, error) {
+	var exists bool
+	err := db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM scout_alerts WHERE object_name = $1 AND rule = $2)`, objectName, rule)
+	return exists, err
+}
+
+// recordAlert records that rule fired for objectName, so it is not
+// delivered again. Call this only once a sink has actually delivered the
+// alert, so a failed send is retried on the next fetch instead of being
+// dedup'd away.
+func recordAlert(db *sqlx.DB, objectName, rule string) error {
+	_, err := db.Exec(`INSERT INTO scout_alerts (object_name, rule) VALUES ($1, $2) ON CONFLICT DO NOTHING`, objectName, rule)
+	return err
+}
+
+func newAlertSink(cfg SinkConfig) (alertSink, error) {
+	switch cfg.Type {
+	case "webhook":
+		if cfg.Webhook == nil {
+			return nil, fmt.Errorf("missing webhook config")
+		}
+		return &webhookSink{url: cfg.Webhook.URL}, nil
+	case "smtp":
+		if cfg.SMTP == nil {
+			return nil, fmt.Errorf("missing smtp config")
+		}
+		return &smtpSink{cfg: *cfg.SMTP}, nil
+	case "mastodon":
+		if cfg.Mastodon == nil {
+			return nil, fmt.Errorf("missing mastodon config")
+		}
+		return &mastodonSink{cfg: *cfg.Mastodon}, nil
+	case "exec":
+		if cfg.Exec == nil {
+			return nil, fmt.Errorf("missing exec config")
+		}
+		return &execSink{cfg: *cfg.Exec}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// webhookSink POSTs the alert as JSON to a configured URL.
+type webhookSink struct{ url string }
+
+func (s *webhookSink) Send(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("bad response %s", res.Status)
+	}
+
+	return nil
+}
+
+// smtpSink emails the alert via a configured SMTP relay.
+type smtpSink struct{ cfg SMTPSinkConfig }
+
+func (s *smtpSink) Send(a Alert) error {
+	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+	msg := fmt.Sprintf("Subject: scoutscrape alert: %s\r\n\r\n%s triggered rule %q (rating=%v, caDist=%v LD)\r\n",
+		a.Rule, a.ObjectName, a.Rule, a.Detail.Rating.V(), a.Detail.CaDist.V())
+
+	return smtp.SendMail(addr, nil, s.cfg.From, s.cfg.To, []byte(msg))
+}
+
+// mastodonSink posts a status update to a Mastodon/ActivityPub instance.
+type mastodonSink struct{ cfg MastodonSinkConfig }
+
+func (s *mastodonSink) Send(a Alert) error {
+	status := fmt.Sprintf("Scout alert: %s triggered rule %q (rating %v)", a.ObjectName, a.Rule, a.Detail.Rating.V())
+
+	form := url.Values{}
+	form.Set("status", status)
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(s.cfg.InstanceURL, "/")+"/api/v1/statuses", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+s.cfg.AccessToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("bad response %s", res.Status)
+	}
+
+	return nil
+}
+
+// execSink runs a configured shell command, passing alert details via the
+// environment so the command doesn't need to parse arguments.
+type execSink struct{ cfg ExecSinkConfig }
+
+func (s *execSink) Send(a Alert) error {
+	cmd := exec.Command(s.cfg.Command, s.cfg.Args...)
+	cmd.Env = append(os.Environ(),
+		"SCOUT_ALERT_RULE="+a.Rule,
+		"SCOUT_ALERT_OBJECT="+a.ObjectName,
+	)
+
+	return cmd.Run()
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cacheLogName    = "cache.log"
+	cacheIndexName  = "cache.idx"
+	cacheAPIVersion = "1.2"
+)
+
+// cacheIndexEntry maps a fetch time to the offset of its frame in the cache
+// log, so a replay can seek straight to the frames it needs instead of
+// scanning the whole log.
+type cacheIndexEntry struct {
+	FetchUnix int64
+	Offset    int64
+}
+
+func cacheLogPath() string   { return filepath.Join(*cachedir, cacheLogName) }
+func cacheIndexPath() string { return filepath.Join(*cachedir, cacheIndexName) }
+
+// ensureCacheDir creates the cache directory if it doesn't already exist and
+// migrates any legacy one-file-per-fetch JSON cache it finds there into the
+// binary log.
+func ensureCacheDir() error {
+	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
+		if err := os.MkdirAll(*cachedir, 0700); err != nil {
+			return err
+		}
+	}
+	return migrateJSONCache()
+}
+
+// migrateJSONCache transparently folds any *.json files left over from the
+// old append-one-file-per-fetch cache into the binary log, oldest first, so
+// existing cache directories keep working after an upgrade. It is a no-op
+// once the legacy files have been migrated away.
+func migrateJSONCache() error {
+	files, err := ioutil.ReadDir(*cachedir)
+	if err != nil {
+		return err
+	}
+
+	var legacy []os.FileInfo
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".json") {
+			legacy = append(legacy, fi)
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	sort.Slice(legacy, func(i, j int) bool { return legacy[i].Name() < legacy[j].Name() })
+
+	log.Printf("cache: migrating %d legacy json cache files to %s", len(legacy), cacheLogName)
+
+	for _, fi := range legacy {
+		path := filepath.Join(*cachedir, fi.Name())
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("migrate %s: %w", fi.Name(), err)
+		}
+
+		var summary Summary
+		if err := json.Unmarshal(body, &summary); err != nil {
+			log.Printf("cache: skipping unreadable legacy cache file %s: %v", fi.Name(), err)
+			continue
+		}
+
+		if err := appendFrame(body, summary.Signature.Version, fi.ModTime()); err != nil {
+			return fmt.Errorf("migrate %s: %w", fi.Name(), err)
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("cache: failed to remove migrated cache file %s: %v", fi.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// appendFrame appends a single frame to the cache log and records its
+// location in the index. Frames wrap the raw JSON body returned by the API
+// rather than a re-encoding of it, since qint/qfloat/mintime carry unexported
+// fields that an encoding/gob round trip can't reach.
+//
+// Frame layout (all integers big-endian):
+//
+//	int64   fetch time, unix seconds
+//	uint16  length of the version string
+//	[]byte  version string
+//	uint32  length of the JSON payload
+//	uint32  CRC-32 (IEEE) of the JSON payload
+//	[]byte  JSON payload
+func appendFrame(payload []byte, version string, fetchTime time.Time) error {
+	logFile, err := os.OpenFile(cacheLogPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	offset, err := logFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFrame(logFile, payload, version, fetchTime); err != nil {
+		return err
+	}
+
+	return appendIndexEntry(cacheIndexEntry{FetchUnix: fetchTime.Unix(), Offset: offset})
+}
+
+func writeFrame(w io.Writer, payload []byte, version string, fetchTime time.Time) error {
+	if err := binary.Write(w, binary.BigEndian, fetchTime.Unix()); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(version))); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if _, err := io.WriteString(w, version); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if err := binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(payload)); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("write payload: %w", err)
+	}
+	return nil
+}
+
+// readFrameAt reads and validates the frame at offset in f, returning its
+// fetch time, declared API version and JSON payload.
+func readFrameAt(f *os.File, offset int64) (time.Time, string, []byte, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	var fetchUnix int64
+	if err := binary.Read(f, binary.BigEndian, &fetchUnix); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read header: %w", err)
+	}
+
+	var versionLen uint16
+	if err := binary.Read(f, binary.BigEndian, &versionLen); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read header: %w", err)
+	}
+	versionBytes := make([]byte, versionLen)
+	if _, err := io.ReadFull(f, versionBytes); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read header: %w", err)
+	}
+
+	var payloadLen uint32
+	if err := binary.Read(f, binary.BigEndian, &payloadLen); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read header: %w", err)
+	}
+	var crc uint32
+	if err := binary.Read(f, binary.BigEndian, &crc); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read header: %w", err)
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(f, payload); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("read payload: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != crc {
+		return time.Time{}, "", nil, fmt.Errorf("crc mismatch")
+	}
+
+	return time.Unix(fetchUnix, 0).UTC(), string(versionBytes), payload, nil
+}
+
+func appendIndexEntry(e cacheIndexEntry) error {
+	indexFile, err := os.OpenFile(cacheIndexPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	return binary.Write(indexFile, binary.BigEndian, e)
+}
+
+// readIndex reads the whole cache index into memory. Entries are returned in
+// the order they were appended, which is chronological since fetches only
+// ever append.
+func readIndex() ([]cacheIndexEntry, error) {
+	f, err := os.Open(cacheIndexPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []cacheIndexEntry
+	for {
+		var e cacheIndexEntry
+		if err := binary.Read(f, binary.BigEndian, &e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func rewriteIndex(entries []cacheIndexEntry) error {
+	tmpPath := cacheIndexPath() + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := binary.Write(f, binary.BigEndian, e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, cacheIndexPath())
+}
+
+// appendToCacheLog persists a freshly fetched summary's raw JSON body to the
+// cache log.
+func appendToCacheLog(payload []byte, version string, fetchTime time.Time) error {
+	if err := ensureCacheDir(); err != nil {
+		return err
+	}
+	return appendFrame(payload, version, fetchTime)
+}
+
+// cacheModifiedSince reports whether the most recent cache frame was
+// fetched after t.
+func cacheModifiedSince(t time.Time) (bool, error) {
+	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := migrateJSONCache(); err != nil {
+		return false, err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(entries) == 0 {
+		return false, nil
+	}
+
+	last := entries[len(entries)-1]
+	return time.Unix(last.FetchUnix, 0).After(t), nil
+}
+
+// replayFromCache replays every summary in the cache log into the database.
+// If *replaySince is set, the index is used to seek directly to frames
+// fetched within that duration of now rather than scanning the whole log.
+func replayFromCache() error {
+	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
+		return nil // nothing to do
+	}
+	if err := migrateJSONCache(); err != nil {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if *replaySince > 0 {
+		cutoff := time.Now().Add(-*replaySince).Unix()
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].FetchUnix >= cutoff })
+		entries = entries[i:]
+	}
+
+	logFile, err := os.Open(cacheLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer logFile.Close()
+
+	summaries := make([]Summary, 0, len(entries))
+
+	for _, e := range entries {
+		_, version, payload, err := readFrameAt(logFile, e.Offset)
+		if err != nil {
+			log.Printf("cache: skipping corrupt frame at offset %d: %v", e.Offset, err)
+			continue
+		}
+
+		if version != cacheAPIVersion {
+			log.Printf("summary: unknown version found in frame at offset %d: %v", e.Offset, version)
+			continue
+		}
+
+		var summary Summary
+		if err := json.Unmarshal(payload, &summary); err != nil {
+			log.Printf("cache: skipping unreadable frame at offset %d: %v", e.Offset, err)
+			continue
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	log.Printf("replaying %d summaries", len(summaries))
+
+	if _, err := writeSummaries(summaries); err != nil {
+		return err
+	}
+
+	if err := runAlerts(summaries); err != nil {
+		log.Printf("alerts: %v", err)
+	}
+
+	return nil
+}
+
+// compactCache rewrites the cache log keeping only frames fetched within
+// retention of now, and rebuilds the index to match.
+func compactCache(retention time.Duration) error {
+	entries, err := readIndex()
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("compact: no cache log found, nothing to do")
+			return nil
+		}
+		return err
+	}
+
+	logFile, err := os.Open(cacheLogPath())
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	tmpPath := cacheLogPath() + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention).Unix()
+
+	var newEntries []cacheIndexEntry
+	kept, dropped := 0, 0
+
+	for _, e := range entries {
+		if e.FetchUnix < cutoff {
+			dropped++
+			continue
+		}
+
+		fetchTime, version, payload, err := readFrameAt(logFile, e.Offset)
+		if err != nil {
+			log.Printf("compact: dropping corrupt frame at offset %d: %v", e.Offset, err)
+			dropped++
+			continue
+		}
+
+		offset, err := tmpFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			tmpFile.Close()
+			return err
+		}
+		if err := writeFrame(tmpFile, payload, version, fetchTime); err != nil {
+			tmpFile.Close()
+			return err
+		}
+
+		newEntries = append(newEntries, cacheIndexEntry{FetchUnix: e.FetchUnix, Offset: offset})
+		kept++
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, cacheLogPath()); err != nil {
+		return err
+	}
+	if err := rewriteIndex(newEntries); err != nil {
+		return err
+	}
+
+	log.Printf("compact: kept %d frames, dropped %d frames older than %s", kept, dropped, retention)
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// daemonMetrics holds the counters and timings exposed on the metrics
+// endpoint. All fields are updated and read atomically so they can be
+// touched from the scheduler goroutine while being served concurrently.
+// Run durations are folded straight into cumulative bucket counts rather
+// than retained per-run, so memory and scrape cost stay flat no matter how
+// long the daemon has been running.
+type daemonMetrics struct {
+	lastSuccessUnix int64 // unix timestamp of the last successful fetch
+	objectsSeen     int64 // cumulative number of objects seen across all fetches
+	inserted        int64 // cumulative number of rows inserted
+	httpFailures    int64 // cumulative number of failed fetch runs; HTTP errors are not counted apart from decode, cache or database errors
+
+	runCount      int64   // cumulative number of completed runs, successful or not
+	runDurationNS int64   // cumulative run duration, in nanoseconds
+	bucketCounts  []int64 // cumulative count of runs with duration <= durationBuckets[i]
+}
+
+func (m *daemonMetrics) recordSuccess(objects, inserted int, d time.Duration) {
+	atomic.StoreInt64(&m.lastSuccessUnix, time.Now().Unix())
+	atomic.AddInt64(&m.objectsSeen, int64(objects))
+	atomic.AddInt64(&m.inserted, int64(inserted))
+	m.recordDuration(d)
+}
+
+func (m *daemonMetrics) recordFailure(d time.Duration) {
+	atomic.AddInt64(&m.httpFailures, 1)
+	m.recordDuration(d)
+}
+
+func (m *daemonMetrics) recordDuration(d time.Duration) {
+	atomic.AddInt64(&m.runCount, 1)
+	atomic.AddInt64(&m.runDurationNS, int64(d))
+
+	secs := d.Seconds()
+	for i, b := range durationBuckets {
+		if secs <= b {
+			atomic.AddInt64(&m.bucketCounts[i], 1)
+		}
+	}
+}
+
+var metrics = &daemonMetrics{bucketCounts: make([]int64, len(durationBuckets))}
+
+// serveDaemon runs scoutscrape as a long-lived service: it polls the Scout
+// API on a jittered interval instead of relying on an external cron, and
+// exposes health and metrics endpoints for operators. It blocks until
+// SIGINT or SIGTERM is received, at which point it finishes any in-flight
+// fetch before returning.
+func serveDaemon() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:    *listenAddr,
+		Handler: daemonMux(),
+	}
+
+	go func() {
+		log.Printf("serving health and metrics on %s", *listenAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server: %v", err)
+		}
+	}()
+
+	runLoop(ctx)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// runLoop runs fetchOnce on a jittered interval until ctx is cancelled. The
+// in-flight fetch (including its database transaction) is always allowed to
+// finish before runLoop returns, so shutdown never truncates a write.
+func runLoop(ctx context.Context) {
+	runOnce := func() {
+		start := time.Now()
+		objects, inserted, err := fetchOnce()
+		d := time.Since(start)
+		if err != nil {
+			metrics.recordFailure(d)
+			log.Printf("fetch failed: %v", err)
+			return
+		}
+		metrics.recordSuccess(objects, inserted, d)
+	}
+
+	runOnce()
+
+	for {
+		wait := *fetchInterval
+		if *fetchJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(*fetchJitter)))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("shutting down, waiting for in-flight fetch to finish")
+			return
+		case <-timer.C:
+			runOnce()
+		}
+	}
+}
+
+func daemonMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	return mux
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	last := atomic.LoadInt64(&metrics.lastSuccessUnix)
+	if last == 0 {
+		// Not ready until the first successful fetch has completed.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "no successful fetch yet")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP scoutscrape_last_success_timestamp_seconds Unix time of the last successful fetch\n")
+	fmt.Fprintf(w, "# TYPE scoutscrape_last_success_timestamp_seconds gauge\n")
+	fmt.Fprintf(w, "scoutscrape_last_success_timestamp_seconds %d\n", atomic.LoadInt64(&metrics.lastSuccessUnix))
+
+	fmt.Fprintf(w, "# HELP scoutscrape_objects_seen_total Number of objects seen across all fetches\n")
+	fmt.Fprintf(w, "# TYPE scoutscrape_objects_seen_total counter\n")
+	fmt.Fprintf(w, "scoutscrape_objects_seen_total %d\n", atomic.LoadInt64(&metrics.objectsSeen))
+
+	fmt.Fprintf(w, "# HELP scoutscrape_inserted_total Number of rows inserted across all fetches\n")
+	fmt.Fprintf(w, "# TYPE scoutscrape_inserted_total counter\n")
+	fmt.Fprintf(w, "scoutscrape_inserted_total %d\n", atomic.LoadInt64(&metrics.inserted))
+
+	fmt.Fprintf(w, "# HELP scoutscrape_http_failures_total Number of fetches that failed\n")
+	fmt.Fprintf(w, "# TYPE scoutscrape_http_failures_total counter\n")
+	fmt.Fprintf(w, "scoutscrape_http_failures_total %d\n", atomic.LoadInt64(&metrics.httpFailures))
+
+	fmt.Fprintf(w, "# HELP scoutscrape_run_duration_seconds Duration of each fetch run\n")
+	fmt.Fprintf(w, "# TYPE scoutscrape_run_duration_seconds histogram\n")
+	writeDurationHistogram(w)
+}
+
+var durationBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120}
+
+func writeDurationHistogram(w http.ResponseWriter) {
+	count := atomic.LoadInt64(&metrics.runCount)
+	sumSeconds := time.Duration(atomic.LoadInt64(&metrics.runDurationNS)).Seconds()
+
+	for i, b := range durationBuckets {
+		fmt.Fprintf(w, "scoutscrape_run_duration_seconds_bucket{le=\"%g\"} %d\n", b, atomic.LoadInt64(&metrics.bucketCounts[i]))
+	}
+	fmt.Fprintf(w, "scoutscrape_run_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "scoutscrape_run_duration_seconds_sum %g\n", sumSeconds)
+	fmt.Fprintf(w, "scoutscrape_run_duration_seconds_count %d\n", count)
+}
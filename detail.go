@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// minTimeBetweenDetailFetches rate limits per-object detail requests so a
+// summary with many candidates doesn't hammer the Scout API.
+const minTimeBetweenDetailFetches = 250 * time.Millisecond
+
+// ObjectDetail is the response from the Scout API when querying a single
+// object by designation (?tdes=<designation>). It carries the orbital
+// elements, ephemeris samples and impact-plane geometry that the summary
+// listing omits.
+type ObjectDetail struct {
+	Object    string `json:"object"`
+	Signature struct {
+		Source  string `json:"source"`
+		Version string `json:"version"`
+	} `json:"signature"`
+	Orbit      OrbitElements      `json:"orbit"`
+	Ephemeris  []EphemerisSample  `json:"eph"`
+	ImpactGeom []ImpactPlanePoint `json:"ip"`
+}
+
+// OrbitElements are the osculating orbital elements for an object at epoch.
+type OrbitElements struct {
+	Epoch flexTime `json:"epoch"` // epoch of the elements (UTC)
+	Ecc   qfloat   `json:"ec"`    // eccentricity
+	A     qfloat   `json:"a"`     // semi-major axis (au)
+	Incl  qfloat   `json:"i"`     // inclination (degrees)
+	Node  qfloat   `json:"om"`    // longitude of ascending node (degrees)
+	Peri  qfloat   `json:"w"`     // argument of periapsis (degrees)
+	M     qfloat   `json:"ma"`    // mean anomaly (degrees)
+	Moid  qfloat   `json:"moid"`  // minimum orbit intersection distance (au)
+}
+
+// EphemerisSample is a single plane-of-sky prediction for an object.
+type EphemerisSample struct {
+	Time    flexTime `json:"time"`    // date/time of the ephemeris sample (UTC)
+	Ra      string   `json:"ra"`      // Right Ascension (hh:mm, J2000)
+	Dec     string   `json:"dec"`     // Declination (degrees, J2000)
+	Vmag    qfloat   `json:"vmag"`    // V-band magnitude estimate
+	RaRate  qfloat   `json:"raRate"`  // RA rate of motion (arc-seconds per minute)
+	DecRate qfloat   `json:"decRate"` // Dec rate of motion (arc-seconds per minute)
+	Elong   qfloat   `json:"elong"`   // solar elongation (degrees)
+}
+
+// ImpactPlanePoint is a single sample of the impact-plane uncertainty
+// ellipse for a potential Earth impact.
+type ImpactPlanePoint struct {
+	Date    flexTime `json:"date"`    // date/time of the potential impact (UTC)
+	SigImp  qfloat   `json:"sigimp"`  // impact probability for this point
+	Width   qfloat   `json:"width"`   // width of the uncertainty region (km)
+	Energy  qfloat   `json:"energy"`  // impact energy (megatons)
+	Ps      qfloat   `json:"ps"`      // Palermo Scale value
+	Stretch qfloat   `json:"stretch"` // stretch of the uncertainty ellipse along the line of variation
+}
+
+// flexTime parses the timestamps in the object-detail endpoint (epoch/eph/ip).
+// We have not been able to confirm against a live response whether these use
+// the same "YYYY-MM-DD HH:MM" format as the summary endpoint's mintime, or a
+// Julian date as JPL orbit epochs commonly do, so flexTime tries both.
+// Unlike mintime, a value that matches neither is logged and left zero
+// rather than failing the decode, so one unexpected field doesn't discard
+// detail we were otherwise able to parse for an object.
+type flexTime time.Time
+
+var flexTimeFormats = []string{
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+func (t *flexTime) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, null) {
+		return nil
+	}
+
+	s := unquote(data)
+
+	for _, format := range flexTimeFormats {
+		if v, err := time.ParseInLocation(format, s, time.UTC); err == nil {
+			*t = flexTime(v)
+			return nil
+		}
+	}
+
+	if jd, err := strconv.ParseFloat(s, 64); err == nil {
+		*t = flexTime(julianDayToTime(jd))
+		return nil
+	}
+
+	log.Printf("detail: could not parse timestamp %q, leaving it unset", s)
+	return nil
+}
+
+// julianDayToTime converts a Julian Day Number to a UTC time.Time.
+func julianDayToTime(jd float64) time.Time {
+	const unixEpochJD = 2440587.5 // Julian Day Number at 1970-01-01T00:00:00Z
+	return time.Unix(int64((jd-unixEpochJD)*86400), 0).UTC()
+}
+
+var detailSchema = `
+CREATE TABLE IF NOT EXISTS scout_orbit (
+	object_name TEXT NOT NULL,
+	last_run    TIMESTAMPTZ NOT NULL,
+	epoch       TIMESTAMPTZ,
+	ecc         REAL,
+	a           REAL,
+	incl        REAL,
+	node        REAL,
+	peri        REAL,
+	m           REAL,
+	moid        REAL,
+	PRIMARY KEY(object_name, last_run)
+);
+
+SELECT create_hypertable('scout_orbit', 'last_run', if_not_exists => true);
+
+CREATE TABLE IF NOT EXISTS scout_ephemeris (
+	object_name TEXT NOT NULL,
+	last_run    TIMESTAMPTZ NOT NULL,
+	time        TIMESTAMPTZ NOT NULL,
+	ra          TEXT,
+	dec         TEXT,
+	vmag        REAL,
+	ra_rate     REAL,
+	dec_rate    REAL,
+	elong       REAL,
+	PRIMARY KEY(object_name, last_run, time)
+);
+
+SELECT create_hypertable('scout_ephemeris', 'last_run', if_not_exists => true);
+
+CREATE TABLE IF NOT EXISTS scout_impact (
+	object_name TEXT NOT NULL,
+	last_run    TIMESTAMPTZ NOT NULL,
+	date        TIMESTAMPTZ NOT NULL,
+	sigimp      REAL,
+	width       REAL,
+	energy      REAL,
+	ps          REAL,
+	stretch     REAL,
+	PRIMARY KEY(object_name, last_run, date)
+);
+
+SELECT create_hypertable('scout_impact', 'last_run', if_not_exists => true);
+`
+
+// fetchObjectDetail fetches the detailed orbital/ephemeris/impact data for a
+// single object designation from the Scout API.
+func fetchObjectDetail(objectName string) (*ObjectDetail, error) {
+	u := scoutAPI + "?tdes=" + url.QueryEscape(objectName)
+
+	res, err := http.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch: bad response %s", res.Status)
+	}
+
+	var detail ObjectDetail
+	if err := json.NewDecoder(res.Body).Decode(&detail); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	if detail.Signature.Version != cacheAPIVersion {
+		return nil, fmt.Errorf("detail: unknown version found: %v", detail.Signature.Version)
+	}
+
+	return &detail, nil
+}
+
+// writeObjectDetails fetches and persists detail data for each object in
+// summaries, observing minTimeBetweenDetailFetches between requests so a
+// summary with many candidates doesn't hammer the Scout API.
+func writeObjectDetails(summaries []Summary) error {
+	opts := buildConnectOptions()
+	db, err := sqlx.Connect("postgres", opts)
+	if err != nil {
+		return fmt.Errorf("connect: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(detailSchema); err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+
+	fetched := 0
+	for _, s := range summaries {
+		for _, d := range s.Data {
+			if fetched > 0 {
+				time.Sleep(minTimeBetweenDetailFetches)
+			}
+			fetched++
+
+			detail, err := fetchObjectDetail(d.ObjectName)
+			if err != nil {
+				log.Printf("detail: failed to fetch %s: %v", d.ObjectName, err)
+				continue
+			}
+
+			if err := insertObjectDetail(db, d.ObjectName, time.Time(d.LastRun), detail); err != nil {
+				log.Printf("detail: failed to store %s: %v", d.ObjectName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func insertObjectDetail(db *sqlx.DB, objectName string, lastRun time.Time, detail *ObjectDetail) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("transaction: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO scout_orbit (
+		object_name, last_run, epoch, ecc, a, incl, node, peri, m, moid
+	) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) ON CONFLICT DO NOTHING`,
+		objectName, lastRun, time.Time(detail.Orbit.Epoch), detail.Orbit.Ecc.V(), detail.Orbit.A.V(),
+		detail.Orbit.Incl.V(), detail.Orbit.Node.V(), detail.Orbit.Peri.V(), detail.Orbit.M.V(), detail.Orbit.Moid.V(),
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("exec orbit: %v", err)
+	}
+
+	for _, e := range detail.Ephemeris {
+		sampleTime := time.Time(e.Time)
+		if sampleTime.IsZero() {
+			log.Printf("detail: skipping ephemeris sample for %s with unparseable time", objectName)
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT INTO scout_ephemeris (
+			object_name, last_run, time, ra, dec, vmag, ra_rate, dec_rate, elong
+		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT DO NOTHING`,
+			objectName, lastRun, sampleTime, e.Ra, e.Dec, e.Vmag.V(), e.RaRate.V(), e.DecRate.V(), e.Elong.V(),
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("exec ephemeris: %v", err)
+		}
+	}
+
+	for _, ip := range detail.ImpactGeom {
+		sampleTime := time.Time(ip.Date)
+		if sampleTime.IsZero() {
+			log.Printf("detail: skipping impact sample for %s with unparseable time", objectName)
+			continue
+		}
+
+		_, err = tx.Exec(`INSERT INTO scout_impact (
+			object_name, last_run, date, sigimp, width, energy, ps, stretch
+		) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) ON CONFLICT DO NOTHING`,
+			objectName, lastRun, sampleTime, ip.SigImp.V(), ip.Width.V(), ip.Energy.V(), ip.Ps.V(), ip.Stretch.V(),
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("exec impact: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
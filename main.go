@@ -28,7 +28,6 @@ dist limit 10;
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -48,12 +47,26 @@ const minTimeBetweenFetches = 15 * time.Minute
 var (
 	cachedir    = kingpin.Flag("cachedir", "Name of the directory to cache results in").Default(defaultCacheDir()).String()
 	replay      = kingpin.Flag("replay", "Replay data from the disk cache").Default("false").Bool()
+	replaySince = kingpin.Flag("replay-since", "When replaying, only replay frames fetched within this duration of now, seeking via the cache index instead of scanning the whole log").Default("0s").Duration()
 	dbname      = kingpin.Flag("dbname", "Name of the database to connect to").Envar("SCOUT_DB_NAME").Default("tsdb").String()
 	user        = kingpin.Flag("user", "Name of the database user").Envar("SCOUT_DB_USER").Default("tsdbadmin").String()
 	password    = kingpin.Flag("password", "Password of the database user").Envar("SCOUT_DB_PASSWORD").Required().String()
 	host        = kingpin.Flag("host", "Hostname of the server to connect to").Envar("SCOUT_DB_HOST").Default("127.0.0.1").String()
 	port        = kingpin.Flag("port", "Port of the server to connect to").Envar("SCOUT_DB_PORT").Default("30000").String()
 	connectOpts = kingpin.Flag("dbopts", "Space separated list of additional database connection options").Envar("SCOUT_DB_OPTS").Default("sslmode=require").String()
+
+	daemon        = kingpin.Flag("daemon", "Run continuously, fetching on a schedule instead of exiting after one fetch").Default("false").Bool()
+	fetchInterval = kingpin.Flag("fetch-interval", "How often to poll the Scout API when running as a daemon").Default("15m").Duration()
+	fetchJitter   = kingpin.Flag("fetch-jitter", "Maximum random jitter to add to each daemon poll interval").Default("1m").Duration()
+	listenAddr    = kingpin.Flag("listen-addr", "Address to serve health and metrics endpoints on when running as a daemon").Default(":9092").String()
+
+	detail = kingpin.Flag("detail", "Fetch and store per-object orbital/ephemeris/impact detail in addition to the summary").Default("true").Bool()
+
+	alertConfigPath = kingpin.Flag("alert-config", "Path to a YAML file configuring alert rules and sinks; alerting is disabled if unset").Default("").String()
+	dryRunAlerts    = kingpin.Flag("dry-run-alerts", "Log alerts that would fire instead of sending them").Default("false").Bool()
+
+	compactCmd       = kingpin.Command("compact", "Rewrite the cache log, dropping frames older than the retention period")
+	compactRetention = compactCmd.Flag("retention", "How far back to retain cache frames").Default("720h").Duration()
 )
 
 func defaultCacheDir() string {
@@ -65,19 +78,33 @@ func defaultCacheDir() string {
 }
 
 func main() {
-	kingpin.Parse()
+	cmd := kingpin.Parse()
 	log.Printf("using cache directory is %s", *cachedir)
 
-	if err := Main(); err != nil {
+	var err error
+	switch cmd {
+	case compactCmd.FullCommand():
+		err = compactCache(*compactRetention)
+	default:
+		err = Main()
+	}
+
+	if err != nil {
 		log.Fatal(err.Error())
 	}
 }
 
+const scoutAPI = "https://ssd-api.jpl.nasa.gov/scout.api"
+
 func Main() error {
 	if *replay {
 		return replayFromCache()
 	}
 
+	if *daemon {
+		return serveDaemon()
+	}
+
 	// Check cache to see if we should fetch from API or not
 	recent, err := cacheModifiedSince(time.Now().Add(-minTimeBetweenFetches))
 	if err != nil {
@@ -88,112 +115,58 @@ func Main() error {
 		return nil
 	}
 
-	u := "https://ssd-api.jpl.nasa.gov/scout.api"
+	_, _, err = fetchOnce()
+	return err
+}
 
-	res, err := http.Get(u)
+// fetchOnce fetches the current summary from the Scout API, writes it to the
+// disk cache and persists it to the database. It reports the number of
+// objects seen and the number of rows inserted so callers can track scraper
+// throughput.
+func fetchOnce() (int, int, error) {
+	res, err := http.Get(scoutAPI)
 	if err != nil {
-		return fmt.Errorf("fetch: %w", err)
+		return 0, 0, fmt.Errorf("fetch: %w", err)
 	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return fmt.Errorf("fetch: bad response %s", res.Status)
+		return 0, 0, fmt.Errorf("fetch: bad response %s", res.Status)
 	}
 
-	cacheFile, err := newCacheFile()
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return fmt.Errorf("cache: %w", err)
+		return 0, 0, fmt.Errorf("fetch: %w", err)
 	}
-	defer cacheFile.Close()
-
-	tee := io.TeeReader(res.Body, cacheFile)
 
 	var summary Summary
-
-	err = json.NewDecoder(tee).Decode(&summary)
-	if err != nil {
-		return fmt.Errorf("decode: %w", err)
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return 0, 0, fmt.Errorf("decode: %w", err)
 	}
 
-	if summary.Signature.Version != "1.2" {
-		return fmt.Errorf("summary: unknown version found: %v", summary.Signature.Version)
+	if summary.Signature.Version != cacheAPIVersion {
+		return 0, 0, fmt.Errorf("summary: unknown version found: %v", summary.Signature.Version)
 	}
 
-	return writeSummaries([]Summary{summary})
-}
-
-func cacheModifiedSince(t time.Time) (bool, error) {
-	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
-		return false, nil
+	if err := appendToCacheLog(body, summary.Signature.Version, time.Now()); err != nil {
+		return 0, 0, fmt.Errorf("cache: %w", err)
 	}
 
-	files, err := ioutil.ReadDir(*cachedir)
+	inserted, err := writeSummaries([]Summary{summary})
 	if err != nil {
-		return false, err
+		return 0, 0, err
 	}
 
-	for _, fi := range files {
-		if !fi.Mode().IsRegular() {
-			continue
-		}
-		if fi.ModTime().After(t) {
-			return true, nil
+	if *detail {
+		if err := writeObjectDetails([]Summary{summary}); err != nil {
+			log.Printf("detail: %v", err)
 		}
 	}
 
-	return false, nil
-}
-
-func newCacheFile() (*os.File, error) {
-	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
-		err := os.MkdirAll(*cachedir, 0700)
-		if err != nil {
-			return nil, err
-		}
+	if err := runAlerts([]Summary{summary}); err != nil {
+		log.Printf("alerts: %v", err)
 	}
 
-	filename := filepath.Join(*cachedir, fmt.Sprintf("%d.json", time.Now().Unix()))
-	return os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-}
-
-func replayFromCache() error {
-	if _, err := os.Stat(*cachedir); os.IsNotExist(err) {
-		return nil // nothing to do
-	}
-
-	files, err := ioutil.ReadDir(*cachedir)
-	if err != nil {
-		return err
-	}
-
-	summaries := make([]Summary, 0, len(files))
-
-	for _, fi := range files {
-		if !fi.Mode().IsRegular() {
-			continue
-		}
-
-		f, err := os.Open(filepath.Join(*cachedir, fi.Name()))
-		if err != nil {
-			return err
-		}
-
-		var summary Summary
-
-		err = json.NewDecoder(f).Decode(&summary)
-		if err != nil {
-			return fmt.Errorf("decode: failed to decode %s: %w", fi.Name(), err)
-		}
-
-		if summary.Signature.Version != "1.2" {
-			log.Printf("summary: unknown version found in summary %s: %v", fi.Name(), summary.Signature.Version)
-			continue
-		}
-
-		summaries = append(summaries, summary)
-	}
-
-	log.Printf("replaying %d summaries", len(summaries))
-
-	return writeSummaries(summaries)
+	return len(summary.Data), inserted, nil
 }
 
 func buildConnectOptions() string {
@@ -220,17 +193,17 @@ func buildConnectOptions() string {
 	return strings.Join(opts, " ")
 }
 
-func writeSummaries(summaries []Summary) error {
+func writeSummaries(summaries []Summary) (int, error) {
 	opts := buildConnectOptions()
 	db, err := sqlx.Connect("postgres", opts)
 	if err != nil {
-		return fmt.Errorf("connect: %v", err)
+		return 0, fmt.Errorf("connect: %v", err)
 	}
 	defer db.Close()
 
 	// Ensure we have the table
 	if _, err := db.Exec(schema); err != nil {
-		return fmt.Errorf("schema: %v", err)
+		return 0, fmt.Errorf("schema: %v", err)
 	}
 
 	stmt, err := db.Prepare(`INSERT INTO scout (
@@ -243,7 +216,7 @@ func writeSummaries(summaries []Summary) error {
 		$21,$22,$23,$24
 	)  ON CONFLICT DO NOTHING`)
 	if err != nil {
-		return fmt.Errorf("prepare: %v", err)
+		return 0, fmt.Errorf("prepare: %v", err)
 	}
 
 	candidates := 0
@@ -251,7 +224,7 @@ func writeSummaries(summaries []Summary) error {
 
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("transaction: %v", err)
+		return 0, fmt.Errorf("transaction: %v", err)
 	}
 	for _, s := range summaries {
 		for _, d := range s.Data {
@@ -284,7 +257,7 @@ func writeSummaries(summaries []Summary) error {
 			)
 			if err != nil {
 				tx.Rollback()
-				return fmt.Errorf("exec: %v", err)
+				return 0, fmt.Errorf("exec: %v", err)
 			}
 			n, _ := res.RowsAffected()
 			inserted += int(n)
@@ -292,10 +265,10 @@ func writeSummaries(summaries []Summary) error {
 	}
 
 	if err := tx.Commit(); err != nil {
-		return err
+		return 0, err
 	}
 
 	log.Printf("added %d observations (%d duplicates ignored)", inserted, candidates-inserted)
 
-	return nil
+	return inserted, nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"strconv"
 	"time"
 )
@@ -65,6 +66,16 @@ func (i *qint) V() interface{} {
 	return nil
 }
 
+// MarshalJSON is defined with a value receiver, unlike UnmarshalJSON, since
+// qint's embedded *int is unexported and encoding/json otherwise marshals it
+// as an empty object.
+func (i qint) MarshalJSON() ([]byte, error) {
+	if i.int == nil {
+		return null, nil
+	}
+	return json.Marshal(*i.int)
+}
+
 type qfloat struct{ *float64 } // nullable
 
 func (f *qfloat) UnmarshalJSON(data []byte) error {
@@ -86,6 +97,15 @@ func (f *qfloat) V() interface{} {
 	return nil
 }
 
+// MarshalJSON is defined with a value receiver for the same reason as
+// qint.MarshalJSON.
+func (f qfloat) MarshalJSON() ([]byte, error) {
+	if f.float64 == nil {
+		return null, nil
+	}
+	return json.Marshal(*f.float64)
+}
+
 func unquote(data []byte) string {
 	if len(data) > 1 && data[0] == data[len(data)-1] && (data[0] == '\'' || data[0] == '"') {
 		return string(data[1 : len(data)-1])
@@ -108,6 +128,13 @@ func (t *mintime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON is defined on mintime directly because a defined type does not
+// inherit time.Time's MarshalJSON, and without this, encoding/json falls
+// back to reflecting over time.Time's unexported fields and emits "{}".
+func (t mintime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Format("2006-01-02 15:04"))
+}
+
 var schema = `
 CREATE TABLE IF NOT EXISTS scout (
 	object_name	      TEXT NOT NULL,